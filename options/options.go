@@ -1,5 +1,7 @@
 package options
 
+import "time"
+
 type Options struct {
 	Dataset              string  `short:"d" long:"dataset" description:"Name of the dataset" default:"aws-$SERVICE-access"`
 	SampleRate           int     `long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
@@ -14,6 +16,23 @@ type Options struct {
 	SamplerType          string  `long:"sampler_type" default:"simple" description:"Type of dynamic sampler to use. Options are 'simple' and 'ema'"`
 	SamplerInterval      int     `long:"sampler_interval" default:"300" description:"Interval between sample rate calculation, in seconds."`
 	SamplerDecay         float64 `long:"sampler_decay" default:"0.5" description:"Used only when sampler_type is set to 'ema'. A value between (0,1) that controls how fast new observations are factored into the moving average. Larger values mean the sample rates are more sensitive to recent observations."`
+	SamplerTopNK         int     `long:"sampler_topn_k" default:"50" description:"Used only when sampler_type is set to 'topn'. Number of top keys per window to always keep (sample rate 1)."`
+	SamplerTopNKey       string  `long:"sampler_topn_key" default:"{{.request_path}} {{.elb_status_code}}" description:"Used only when sampler_type is set to 'topn'. Go template over event fields used to derive the key each event is ranked by."`
+	SamplerTopNWindows   int     `long:"sampler_topn_windows" default:"3" description:"Used only when sampler_type is set to 'topn'. Number of past windows whose top keys are kept in the allowlist."`
+
+	LokiBatchSize  int           `long:"loki_batch_size" default:"1048576" description:"Maximum uncompressed size, in bytes, of a batch of log lines before it is flushed to Loki"`
+	LokiBatchWait  time.Duration `long:"loki_batch_wait" default:"1s" description:"Maximum amount of time to wait before flushing a batch of log lines to Loki, even if loki_batch_size hasn't been reached"`
+	LokiMaxRetries int           `long:"loki_max_retries" default:"5" description:"Maximum number of times to retry sending a batch to Loki before dropping it"`
+	LokiMinBackoff time.Duration `long:"loki_min_backoff" default:"500ms" description:"Minimum backoff between retried Loki pushes"`
+	LokiMaxBackoff time.Duration `long:"loki_max_backoff" default:"5m" description:"Maximum backoff between retried Loki pushes"`
+
+	OTLPEndpoint string            `long:"otlp_endpoint" description:"Endpoint of an OTLP receiver (e.g. an OpenTelemetry Collector) to export logs and traces to"`
+	OTLPProtocol string            `long:"otlp_protocol" default:"grpc" description:"Protocol to use when talking to the OTLP endpoint. Options are 'grpc' and 'http/protobuf'"`
+	OTLPHeaders  map[string]string `long:"otlp_header" description:"Header to send with every OTLP request, e.g. for tenant or API key auth. May be repeated"`
+	OTLPInsecure bool              `long:"otlp_insecure" description:"Disable TLS when talking to the OTLP endpoint"`
+	OTLPCACert   string            `long:"otlp_ca_cert" description:"Path to a CA certificate to verify the OTLP endpoint's TLS certificate"`
+
+	Sinks []string `long:"sink" description:"Sink to send events to, with an optional filter, e.g. 'loki:elb_status_code>=500' or 'honeycomb:*'. May be repeated. Defaults to loki (plus otlp, if otlp_endpoint is set) when omitted."`
 
 	Version bool   `short:"V" long:"version" description:"Show version"`
 	APIHost string `hidden:"true" long:"api_host" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
@@ -0,0 +1,109 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// cloudTrailRecords mirrors the `{"Records": [...]}` envelope every
+// CloudTrail log object is wrapped in.
+type cloudTrailRecords struct {
+	Records []map[string]interface{} `json:"Records"`
+}
+
+// CloudTrailEventParser implements EventParser for AWS CloudTrail log
+// objects, which are gzip'd JSON rather than the nginx-style access log
+// lines the ELB/ALB/CloudFront formats use.
+type CloudTrailEventParser struct {
+	Opt *options.Options
+}
+
+func (p *CloudTrailEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
+	f, err := os.Open(obj.Filename)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", obj.Filename, err)
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader for %s: %s", obj.Object, err)
+	}
+	defer gzr.Close()
+
+	var records cloudTrailRecords
+	if err := json.NewDecoder(gzr).Decode(&records); err != nil {
+		return fmt.Errorf("error decoding cloudtrail records in %s: %s", obj.Object, err)
+	}
+
+	for _, record := range records.Records {
+		out <- cloudTrailRecordToEvent(record)
+	}
+
+	return nil
+}
+
+// cloudTrailRecordToEvent flattens a CloudTrail record into a
+// Honeycomb-friendly flat event, unfolding the commonly-nested
+// userIdentity/requestParameters/responseElements objects into dotted
+// top-level keys.
+func cloudTrailRecordToEvent(record map[string]interface{}) event.Event {
+	ev := event.Event{Data: map[string]interface{}{}}
+
+	for _, nested := range []string{"userIdentity", "requestParameters", "responseElements"} {
+		val, ok := record[nested]
+		if !ok {
+			continue
+		}
+		flattenInto(ev.Data, nested, val)
+		delete(record, nested)
+	}
+
+	for k, v := range record {
+		ev.Data[k] = v
+	}
+
+	if eventTime, ok := record["eventTime"].(string); ok {
+		if tm, err := time.Parse(time.RFC3339, eventTime); err == nil {
+			ev.Timestamp = tm
+		}
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+
+	return ev
+}
+
+// flattenInto writes val into data under dotted keys rooted at prefix, e.g.
+// userIdentity.arn, requestParameters.bucketName. Non-object values are
+// written directly under prefix.
+func flattenInto(data map[string]interface{}, prefix string, val interface{}) {
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		data[prefix] = val
+		return
+	}
+	for k, v := range obj {
+		flattenInto(data, prefix+"."+k, v)
+	}
+}
+
+// DynSample applies the configured sampler (see options.Options.SamplerType)
+// to CloudTrail events.
+func (p *CloudTrailEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	sampler := NewSampler(p.Opt)
+	for ev := range in {
+		if sampler.Sample(&ev) {
+			out <- ev
+		}
+	}
+	close(out)
+}
@@ -0,0 +1,429 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	colllogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/protobuf"
+)
+
+// otlpTransport abstracts the two wire formats OTLP supports so otlpExporter
+// doesn't have to care which one is in use.
+type otlpTransport interface {
+	exportTraces(ctx context.Context, req *colltracepb.ExportTraceServiceRequest) error
+	exportLogs(ctx context.Context, req *colllogspb.ExportLogsServiceRequest) error
+	Close() error
+}
+
+// otlpExporter converts ALB/ELB/CloudFront events into OTLP and ships them to
+// an OTLP receiver, such as an OpenTelemetry Collector. Events that carry
+// trace context (populated by addTraceData) become spans, with the load
+// balancer as the root of the trace when edge_mode is set; every event is
+// also exported as a LogRecord, tagged with the same trace_id/span_id so
+// logs and spans correlate in the backend.
+type otlpExporter struct {
+	transport otlpTransport
+}
+
+func newOTLPExporter(opt *options.Options) (*otlpExporter, error) {
+	var transport otlpTransport
+	var err error
+
+	switch opt.OTLPProtocol {
+	case otlpProtocolHTTP:
+		transport, err = newOTLPHTTPTransport(opt)
+	case otlpProtocolGRPC, "":
+		transport, err = newOTLPGRPCTransport(opt)
+	default:
+		return nil, fmt.Errorf("unknown otlp_protocol %q, want %q or %q", opt.OTLPProtocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &otlpExporter{transport: transport}, nil
+}
+
+func (o *otlpExporter) Name() string { return "otlp" }
+
+func (o *otlpExporter) Close() error {
+	return o.transport.Close()
+}
+
+// Send exports a batch of events as both OTLP spans (for the subset with
+// trace context) and OTLP log records (for all of them).
+func (o *otlpExporter) Send(ctx context.Context, events []event.Event) error {
+	var spans []*tracepb.Span
+	var logRecords []*logspb.LogRecord
+
+	for _, ev := range events {
+		logRecords = append(logRecords, eventToLogRecord(ev))
+		if span, ok := eventToSpan(ev); ok {
+			spans = append(spans, span)
+		}
+	}
+
+	resource := &resourcepb.Resource{
+		Attributes: []*commonpb.KeyValue{stringAttr("service.name", "honeyaws")},
+	}
+
+	if len(spans) > 0 {
+		traceReq := &colltracepb.ExportTraceServiceRequest{
+			ResourceSpans: []*tracepb.ResourceSpans{
+				{
+					Resource:   resource,
+					ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+				},
+			},
+		}
+		if err := o.transport.exportTraces(ctx, traceReq); err != nil {
+			return fmt.Errorf("exporting otlp traces: %s", err)
+		}
+	}
+
+	if len(logRecords) > 0 {
+		logsReq := &colllogspb.ExportLogsServiceRequest{
+			ResourceLogs: []*logspb.ResourceLogs{
+				{
+					Resource:  resource,
+					ScopeLogs: []*logspb.ScopeLogs{{LogRecords: logRecords}},
+				},
+			},
+		}
+		if err := o.transport.exportLogs(ctx, logsReq); err != nil {
+			return fmt.Errorf("exporting otlp logs: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// eventToLogRecord exports an event as one LogRecord whose body is all of the
+// event's fields JSON-encoded, tagging it with the
+// same trace_id/span_id (when present) used for the corresponding span so
+// logs and traces correlate in the backend.
+func eventToLogRecord(ev event.Event) *logspb.LogRecord {
+	body, err := stringAttrValue(ev.Data)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to encode event body for otlp log export")
+	}
+
+	rec := &logspb.LogRecord{
+		TimeUnixNano: uint64(ev.Timestamp.UnixNano()),
+		Body:         body,
+	}
+
+	if traceID, ok := ev.Data["trace.trace_id"].(string); ok {
+		if tid, err := traceIDBytes(traceID); err == nil {
+			rec.TraceId = tid
+		}
+	}
+	if spanID, ok := ev.Data["trace.span_id"].(string); ok {
+		if sid, err := spanIDBytes(spanID); err == nil {
+			rec.SpanId = sid
+		}
+	}
+
+	return rec
+}
+
+func eventToSpan(ev event.Event) (*tracepb.Span, bool) {
+	traceID, ok := ev.Data["trace.trace_id"].(string)
+	if !ok || traceID == "" {
+		return nil, false
+	}
+	spanID, ok := ev.Data["trace.span_id"].(string)
+	if !ok || spanID == "" {
+		return nil, false
+	}
+
+	tid, err := traceIDBytes(traceID)
+	if err != nil {
+		logrus.WithError(err).Debug("skipping span with malformed trace id")
+		return nil, false
+	}
+	sid, err := spanIDBytes(spanID)
+	if err != nil {
+		logrus.WithError(err).Debug("skipping span with malformed span id")
+		return nil, false
+	}
+
+	start := ev.Timestamp
+	durationMs, _ := ev.Data["duration_ms"].(float64)
+	end := start.Add(time.Duration(durationMs * float64(time.Millisecond)))
+
+	span := &tracepb.Span{
+		TraceId:           tid,
+		SpanId:            sid,
+		Name:              fmt.Sprintf("%v", ev.Data["name"]),
+		Kind:              tracepb.Span_SPAN_KIND_SERVER,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		EndTimeUnixNano:   uint64(end.UnixNano()),
+	}
+
+	if parentID, ok := ev.Data["trace.parent_id"].(string); ok && parentID != "" {
+		if pid, err := spanIDBytes(parentID); err == nil {
+			span.ParentSpanId = pid
+		}
+	}
+
+	if status, ok := ev.Data["elb_status_code"]; ok {
+		span.Attributes = append(span.Attributes, stringAttr("http.status_code", fmt.Sprintf("%v", status)))
+		if code, ok := statusCode(status); ok && code >= 500 {
+			span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+		}
+	}
+
+	return span, true
+}
+
+// statusCode normalizes an elb_status_code field -- which event parsers may
+// yield as an int64, a float64, or a string -- to an int64.
+func statusCode(raw interface{}) (int64, bool) {
+	switch v := raw.(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// traceIDBytes decodes the AWS-flavored trace id (a hyphenated timestamp +
+// random hex suffix, e.g. "1-5a88eced-40876ce050d010360bfb23bd") into the 16
+// raw bytes an OTLP trace id requires.
+func traceIDBytes(s string) ([]byte, error) {
+	hexPart := ""
+	for i, part := range hexSplit(s) {
+		if i == 0 {
+			continue // version field, not part of the id
+		}
+		hexPart += part
+	}
+	b, err := hex.DecodeString(hexPart)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 16 {
+		return nil, fmt.Errorf("trace id %q decodes to %d bytes, want 16", s, len(b))
+	}
+	return b, nil
+}
+
+// spanIDBytes decodes a span id into the 8 raw bytes an OTLP span id
+// requires. A hyphenated X-Ray style id (the Self or Root value that
+// addTraceData stores as trace.span_id) has its version field dropped first,
+// as in traceIDBytes; ids longer than 8 bytes keep their last 8 bytes.
+func spanIDBytes(s string) ([]byte, error) {
+	if parts := hexSplit(s); len(parts) > 1 {
+		s = ""
+		for _, part := range parts[1:] {
+			s += part
+		}
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 8 {
+		b = b[len(b)-8:]
+	}
+	for len(b) < 8 {
+		b = append([]byte{0}, b...)
+	}
+	return b, nil
+}
+
+func hexSplit(s string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '-' {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func stringAttrValue(data map[string]interface{}) (*commonpb.AnyValue, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: ""}}, err
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(b)}}, nil
+}
+
+// grpcTransport sends OTLP requests over gRPC.
+type grpcTransport struct {
+	conn        *grpc.ClientConn
+	traceClient colltracepb.TraceServiceClient
+	logsClient  colllogspb.LogsServiceClient
+	headers     map[string]string
+}
+
+func newOTLPGRPCTransport(opt *options.Options) (*grpcTransport, error) {
+	var dialOpts []grpc.DialOption
+
+	if opt.OTLPInsecure {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	} else {
+		tlsConfig := &tls.Config{}
+		if opt.OTLPCACert != "" {
+			pem, err := ioutil.ReadFile(opt.OTLPCACert)
+			if err != nil {
+				return nil, fmt.Errorf("reading otlp_ca_cert: %s", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opt.OTLPCACert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	conn, err := grpc.Dial(opt.OTLPEndpoint, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("dialing otlp endpoint %s: %s", opt.OTLPEndpoint, err)
+	}
+
+	return &grpcTransport{
+		conn:        conn,
+		traceClient: colltracepb.NewTraceServiceClient(conn),
+		logsClient:  colllogspb.NewLogsServiceClient(conn),
+		headers:     opt.OTLPHeaders,
+	}, nil
+}
+
+func (t *grpcTransport) outgoingContext(ctx context.Context) context.Context {
+	if len(t.headers) == 0 {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.New(t.headers))
+}
+
+func (t *grpcTransport) exportTraces(ctx context.Context, req *colltracepb.ExportTraceServiceRequest) error {
+	_, err := t.traceClient.Export(t.outgoingContext(ctx), req)
+	return err
+}
+
+func (t *grpcTransport) exportLogs(ctx context.Context, req *colllogspb.ExportLogsServiceRequest) error {
+	_, err := t.logsClient.Export(t.outgoingContext(ctx), req)
+	return err
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// httpTransport sends OTLP requests as HTTP/protobuf, per the OTLP spec's
+// /v1/traces and /v1/logs endpoints.
+type httpTransport struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func newOTLPHTTPTransport(opt *options.Options) (*httpTransport, error) {
+	transport := &http.Transport{}
+	if !opt.OTLPInsecure {
+		tlsConfig := &tls.Config{}
+		if opt.OTLPCACert != "" {
+			pem, err := ioutil.ReadFile(opt.OTLPCACert)
+			if err != nil {
+				return nil, fmt.Errorf("reading otlp_ca_cert: %s", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opt.OTLPCACert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &httpTransport{
+		endpoint: opt.OTLPEndpoint,
+		headers:  opt.OTLPHeaders,
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (t *httpTransport) post(ctx context.Context, path string, msg proto.Message) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp http export to %s failed with status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *httpTransport) exportTraces(ctx context.Context, req *colltracepb.ExportTraceServiceRequest) error {
+	return t.post(ctx, "/v1/traces", req)
+}
+
+func (t *httpTransport) exportLogs(ctx context.Context, req *colllogspb.ExportLogsServiceRequest) error {
+	return t.post(ctx, "/v1/logs", req)
+}
+
+func (t *httpTransport) Close() error {
+	return nil
+}
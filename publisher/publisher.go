@@ -2,10 +2,12 @@ package publisher
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
@@ -24,6 +26,8 @@ const (
 	AWSApplicationLoadBalancerFormat = "aws_alb"
 	AWSElasticLoadBalancerFormat     = "aws_elb"
 	AWSCloudFrontWebFormat           = "aws_cf_web"
+	AWSVPCFlowLogFormat              = "aws_vpc_flow_log"
+	AWSCloudTrailFormat              = "aws_cloudtrail"
 )
 
 var (
@@ -85,6 +89,22 @@ type EventParser interface {
 	DynSample(in <-chan event.Event, out chan<- event.Event)
 }
 
+// NewEventParser is the --service selection point: it builds the EventParser
+// for a given format constant (AWSVPCFlowLogFormat, AWSCloudTrailFormat,
+// etc.), the way newSinkByName does for --sink. The ELB/ALB/CloudFront
+// formats predate this function and are constructed by the downloader
+// command directly; route those through here too when it's next touched.
+func NewEventParser(format string, opt *options.Options) (EventParser, error) {
+	switch format {
+	case AWSVPCFlowLogFormat:
+		return &VPCFlowLogEventParser{Opt: opt}, nil
+	case AWSCloudTrailFormat:
+		return &CloudTrailEventParser{Opt: opt}, nil
+	default:
+		return nil, fmt.Errorf("no EventParser registered for service format %q", format)
+	}
+}
+
 // HoneycombPublisher implements Publisher and sends the entries provided to
 // Honeycomb. Publisher allows us to have only one point of entry to sending
 // events to Honeycomb (if desired), as well as isolate line parsing, sampling,
@@ -96,6 +116,8 @@ type HoneycombPublisher struct {
 	SampleRate          int
 	FinishedObjects     chan string
 	parsedCh, sampledCh chan event.Event
+	sinks               []*configuredSink
+	pipelineDone        chan struct{}
 }
 
 func NewHoneycombPublisher(opt *options.Options, stater state.Stater, eventParser EventParser) *HoneycombPublisher {
@@ -105,15 +127,58 @@ func NewHoneycombPublisher(opt *options.Options, stater state.Stater, eventParse
 		FinishedObjects: make(chan string),
 	}
 
+	sinks, err := buildSinks(opt)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure sinks")
+	}
+	hp.sinks = sinks
+
 	hp.parsedCh = make(chan event.Event)
 	hp.sampledCh = make(chan event.Event)
-
-	go sendEventsToHoneycomb(hp.sampledCh, opt.EdgeMode, opt.GrafanaCloudID, opt.GrafanaCloudEndpoint, opt.GrafanaCloudAPIKey, opt.Environment)
-	go hp.EventParser.DynSample(hp.parsedCh, hp.sampledCh)
+	shapedCh := make(chan event.Event)
+	hp.pipelineDone = make(chan struct{})
+
+	// Shape events (request URL shredding, etc.) before sampling, so
+	// samplers that key off shaped fields like request_path see them --
+	// see topNSampler's default sampler_topn_key.
+	go shapeEvents(hp.parsedCh, shapedCh, opt.EdgeMode, hasOTLPSink(hp.sinks))
+	go hp.EventParser.DynSample(shapedCh, hp.sampledCh)
+	go func() {
+		dispatchToSinks(hp.sampledCh, hp.sinks)
+		close(hp.pipelineDone)
+	}()
 
 	return hp
 }
 
+// hasOTLPSink reports whether any of sinks is an OTLP exporter. Trace
+// extraction is only worth the cost when something will actually consume it.
+func hasOTLPSink(sinks []*configuredSink) bool {
+	for _, cs := range sinks {
+		if _, ok := cs.sink.(*otlpExporter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shapeEvents applies the processing common to every downstream sink --
+// request URL shredding, dropping AWS's -1 sentinel timing values, and (when
+// an OTLP sink is configured) extracting trace context from the ALB trace_id
+// header -- before events are fanned out.
+func shapeEvents(in <-chan event.Event, out chan<- event.Event, edgeMode, extractTraceData bool) {
+	shaper := requestShaper{&urlshaper.Parser{}}
+	for ev := range in {
+		shaper.Shape("request", &ev)
+		dropNegativeTimes(&ev)
+		if extractTraceData {
+			addTraceData(&ev, edgeMode)
+		}
+		out <- ev
+	}
+	close(out)
+}
+
 // dropNegativeTimes is a helper method to eliminate AWS setting certain fields
 // such as backend_processing_time to -1 indicating a timeout or network error.
 // Since Honeycomb handles sparse data fine, we just delete these fields when
@@ -228,38 +293,149 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
-func sendEventsToHoneycomb(in <-chan event.Event, edgeMode bool, grafanaID string, grafanaEndpoint string, grafanaAPIKey string, environment string) {
-	shaper := requestShaper{&urlshaper.Parser{}}
-	for ev := range in {
-		shaper.Shape("request", &ev)
-		dropNegativeTimes(&ev)
-		//addTraceData(&ev, edgeMode)
-		data, err := json.Marshal(ev.Data)
-		if err != nil {
-			logrus.Error(err)
-		}
+// lokiClient is a single, tuned http.Client shared across every push so we
+// don't pay connection setup costs per batch.
+var lokiClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// lokiBatch accumulates events destined for a single Loki stream (grouped by
+// label set) until it's large enough to flush. The flush-by-age half of
+// batching (--loki_batch_wait) is handled upstream by the configuredSink
+// batcher that calls lokiSink.Send, so lokiBatch itself only tracks size.
+type lokiBatch struct {
+	labels   map[string]string
+	values   [][]string
+	byteSize int
+}
+
+func newLokiBatch(labels map[string]string) *lokiBatch {
+	return &lokiBatch{labels: labels}
+}
+
+func (b *lokiBatch) add(ts time.Time, line string) {
+	b.values = append(b.values, []string{strconv.FormatInt(ts.UnixNano(), 10), line})
+	b.byteSize += len(line)
+}
 
-		jsonPayload := Streams{
-			Streams: []Stream{
-				Stream{
-					Stream: map[string]string{"environment": environment, "service": "honeyaws", "aws_elb": fmt.Sprintf("%v", ev.Data["elb"])},
-					Values: []interface{}{[]string{strconv.FormatInt(ev.Timestamp.UnixNano(), 10), string(data)}},
-				},
+func (b *lokiBatch) full(maxBatchSize int) bool {
+	return b.byteSize >= maxBatchSize || len(b.values) >= 1000
+}
+
+// streamKey returns the per-stream label signature used to group log lines,
+// derived from the same label set that's attached to the pushed stream.
+func streamKey(environment, elb string) string {
+	return environment + "/" + elb
+}
+
+// minBackoffFloor is the smallest backoff pushLokiBatch will ever sleep for,
+// regardless of --loki_min_backoff -- a configured 0 (or negative) value
+// would otherwise never grow under nextBackoff's doubling, so every retry
+// would fire back to back.
+const minBackoffFloor = 10 * time.Millisecond
+
+// pushLokiBatch gzip-encodes the batch and POSTs it to Loki, retrying with
+// exponential backoff and jitter on transient failures. It honors
+// Retry-After on 429/503 responses, as newer Grafana Agent versions do.
+func pushLokiBatch(b *lokiBatch, grafanaEndpoint, grafanaID, grafanaAPIKey string, maxRetries int, minBackoff, maxBackoff time.Duration) error {
+	jsonPayload := Streams{
+		Streams: []Stream{
+			{
+				Stream: b.labels,
+				Values: toInterfaceSlice(b.values),
 			},
+		},
+	}
+
+	body, err := json.Marshal(jsonPayload)
+	if err != nil {
+		return fmt.Errorf("marshaling loki payload: %s", err)
+	}
+
+	var gzBody bytes.Buffer
+	gzw := gzip.NewWriter(&gzBody)
+	if _, err := gzw.Write(body); err != nil {
+		return fmt.Errorf("gzipping loki payload: %s", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("gzipping loki payload: %s", err)
+	}
+
+	backoff := minBackoff
+	if backoff < minBackoffFloor {
+		backoff = minBackoffFloor
+	}
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			logrus.WithFields(logrus.Fields{
+				"attempt": attempt,
+				"backoff": backoff,
+			}).Warn("retrying loki push")
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff, maxBackoff)
 		}
-		b, _ := json.Marshal(jsonPayload)
-		req, err := http.NewRequest("POST", grafanaEndpoint, bytes.NewBuffer(b))
+
+		req, err := http.NewRequest("POST", grafanaEndpoint, bytes.NewReader(gzBody.Bytes()))
 		if err != nil {
-			logrus.Error(err)
+			return fmt.Errorf("building loki request: %s", err)
 		}
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
 		req.Header.Add("Authorization", "Basic "+basicAuth(grafanaID, grafanaAPIKey))
-		client := &http.Client{}
-		_, err = client.Do(req)
+
+		resp, err := lokiClient.Do(req)
 		if err != nil {
-			logrus.Error(err)
+			lastErr = err
+			continue
+		}
+		retryAfter := resp.Header.Get("Retry-After")
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+
+		lastErr = fmt.Errorf("loki push failed with status %d", resp.StatusCode)
+
+		// Only 429/503 are worth retrying; anything else (e.g. 400 bad
+		// request) will never succeed on retry.
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return lastErr
 		}
+
+		if d, err := time.ParseDuration(retryAfter + "s"); err == nil && d > 0 {
+			backoff = d
+		}
+	}
+
+	return lastErr
+}
+
+// nextBackoff doubles the backoff and adds up to 20% jitter, capped at max.
+func nextBackoff(cur, max time.Duration) time.Duration {
+	next := cur * 2
+	jitterRange := int64(next) / 5
+	if jitterRange >= 1 {
+		next += time.Duration(rand.Int63n(jitterRange))
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+func toInterfaceSlice(values [][]string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
 	}
+	return out
 }
 
 func (hp *HoneycombPublisher) Publish(downloadedObj state.DownloadedObject) error {
@@ -280,7 +456,20 @@ func (hp *HoneycombPublisher) Publish(downloadedObj state.DownloadedObject) erro
 	return nil
 }
 
-// Close flushes outstanding sends
+// Close drains the pipeline and flushes outstanding sends on every
+// configured sink. Callers must not call Publish again afterwards.
 func (hp *HoneycombPublisher) Close() {
+	// Closing parsedCh top-down -- rather than closing each sink's buffer
+	// directly -- lets shapeEvents, DynSample, and dispatchToSinks each
+	// close their own output in turn, so no in-flight event is offered to
+	// a sink whose channel we've already closed out from under it.
+	close(hp.parsedCh)
+	<-hp.pipelineDone
+
+	for _, cs := range hp.sinks {
+		if err := cs.sink.Close(); err != nil {
+			logrus.WithError(err).WithField("sink", cs.sink.Name()).Error("error closing sink")
+		}
+	}
 	libhoney.Close()
 }
@@ -0,0 +1,389 @@
+package publisher
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// Sampler decides whether an individual event should be kept, mutating it
+// (e.g. to record the sample rate it was kept at) as needed.
+type Sampler interface {
+	Sample(ev *event.Event) bool
+}
+
+// NewSampler builds the Sampler configured by opt.SamplerType. EventParsers
+// that don't implement their own dynamic sampling can use this as their
+// DynSample building block.
+func NewSampler(opt *options.Options) Sampler {
+	switch opt.SamplerType {
+	case "topn":
+		s, err := newTopNSampler(opt)
+		if err != nil {
+			logrus.WithError(err).Error("failed to build topn sampler, falling back to simple sampling")
+			return &simpleSampler{Rate: opt.SampleRate}
+		}
+		return s
+	case "ema":
+		return newEMASampler(opt)
+	case "simple", "":
+		return &simpleSampler{Rate: opt.SampleRate}
+	default:
+		logrus.WithField("sampler_type", opt.SamplerType).Warn("unknown sampler_type, falling back to simple sampling")
+		return &simpleSampler{Rate: opt.SampleRate}
+	}
+}
+
+// simpleSampler uniformly samples 1 in Rate events.
+type simpleSampler struct {
+	Rate int
+}
+
+func (s *simpleSampler) Sample(ev *event.Event) bool {
+	rate := s.Rate
+	if rate < 1 {
+		rate = 1
+	}
+	if rate == 1 || rand.Intn(rate) == 0 {
+		ev.SampleRate = rate
+		return true
+	}
+	return false
+}
+
+// emaSampler samples each key (by default, the status code) in proportion to
+// how often it's seen relative to the rarest key, using an exponentially
+// weighted moving average of per-window counts so the rates adapt gradually
+// rather than jumping on every window rotation. A heavy-hitter key ends up
+// with a high rate (sampled down hard); a key as rare as the rarest one seen
+// gets rate 1 (always kept). Tuned by opt.SamplerDecay and opt.SamplerInterval.
+// Only keys seen during a window are folded into the average when it rotates;
+// a key with no events in a window keeps its previous average.
+type emaSampler struct {
+	keyFunc func(ev *event.Event) string
+	decay   float64
+
+	mu     sync.Mutex
+	avg    map[string]float64
+	counts map[string]int
+	rates  map[string]int
+}
+
+func newEMASampler(opt *options.Options) *emaSampler {
+	decay := opt.SamplerDecay
+	if decay <= 0 || decay > 1 {
+		decay = 0.5
+	}
+
+	s := &emaSampler{
+		keyFunc: emaKeyByStatusCode,
+		decay:   decay,
+		avg:     map[string]float64{},
+		counts:  map[string]int{},
+		rates:   map[string]int{},
+	}
+
+	interval := time.Duration(opt.SamplerInterval) * time.Second
+	if interval <= 0 {
+		interval = 300 * time.Second
+	}
+	go s.rotateEvery(interval)
+
+	return s
+}
+
+func emaKeyByStatusCode(ev *event.Event) string {
+	return fmt.Sprintf("%v", ev.Data["elb_status_code"])
+}
+
+func (s *emaSampler) Sample(ev *event.Event) bool {
+	key := s.keyFunc(ev)
+
+	s.mu.Lock()
+	s.counts[key]++
+	rate := s.rates[key]
+	s.mu.Unlock()
+
+	if rate < 1 {
+		rate = 1
+	}
+	if rate == 1 || rand.Intn(rate) == 0 {
+		ev.SampleRate = rate
+		return true
+	}
+	return false
+}
+
+// rotateEvery folds the current window's counts into the moving average on a
+// fixed interval and recomputes each key's sample rate from it.
+func (s *emaSampler) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.rotate()
+	}
+}
+
+func (s *emaSampler) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, count := range s.counts {
+		s.avg[key] = s.avg[key]*(1-s.decay) + float64(count)*s.decay
+	}
+
+	// min is the rarest key's moving average -- the baseline every other
+	// key's rate is computed relative to, so the rarest key lands at rate 1.
+	var min float64
+	for _, avg := range s.avg {
+		if avg > 0 && (min == 0 || avg < min) {
+			min = avg
+		}
+	}
+
+	rates := make(map[string]int, len(s.avg))
+	for key, avg := range s.avg {
+		rate := 1
+		if min > 0 && avg > 0 {
+			rate = int(avg / min)
+			if rate < 1 {
+				rate = 1
+			}
+		}
+		rates[key] = rate
+	}
+	s.rates = rates
+	s.counts = map[string]int{}
+}
+
+// topNSampler always keeps every key that was among the top K (by a per-window
+// count-min sketch) in any of the last `windows` completed windows, falling
+// back to uniform sampling for everything else; until the first rotation,
+// every key falls back. This
+// preserves heavy hitters (for volume-accurate stats) while still
+// guaranteeing visibility of low-frequency but distinct traffic that pure
+// random sampling would otherwise lose.
+type topNSampler struct {
+	keyTemplate *template.Template
+	fallback    simpleSampler
+
+	k       int
+	windows int
+
+	mu        sync.Mutex
+	cms       *countMinSketch
+	topHeap   *topKHeap
+	allowed   map[string]bool
+	windowLog []map[string]bool
+}
+
+func newTopNSampler(opt *options.Options) (*topNSampler, error) {
+	tmpl, err := template.New("sampler_topn_key").Parse(opt.SamplerTopNKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k := opt.SamplerTopNK
+	if k < 1 {
+		k = 1
+	}
+	windows := opt.SamplerTopNWindows
+	if windows < 1 {
+		windows = 1
+	}
+
+	s := &topNSampler{
+		keyTemplate: tmpl,
+		fallback:    simpleSampler{Rate: opt.SampleRate},
+		k:           k,
+		windows:     windows,
+		cms:         newCountMinSketch(),
+		topHeap:     newTopKHeap(k),
+		allowed:     map[string]bool{},
+	}
+
+	interval := time.Duration(opt.SamplerInterval) * time.Second
+	if interval <= 0 {
+		interval = 300 * time.Second
+	}
+	go s.rotateEvery(interval)
+
+	return s, nil
+}
+
+func (s *topNSampler) key(ev *event.Event) string {
+	var buf bytes.Buffer
+	if err := s.keyTemplate.Execute(&buf, ev.Data); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+func (s *topNSampler) Sample(ev *event.Event) bool {
+	key := s.key(ev)
+
+	s.mu.Lock()
+	s.cms.add(key)
+	s.topHeap.observe(key, s.cms.estimate(key))
+	keep := s.allowed[key]
+	s.mu.Unlock()
+
+	if keep {
+		ev.Data["sample_reason"] = "topn"
+		ev.Data["sample_rate"] = 1
+		ev.SampleRate = 1
+		return true
+	}
+
+	return s.fallback.Sample(ev)
+}
+
+// rotateEvery rotates the sampling window on a fixed interval, recomputing
+// the allowlist as the union of the top-K keys across the last `windows`
+// rotations.
+func (s *topNSampler) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.rotate()
+	}
+}
+
+func (s *topNSampler) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	top := s.topHeap.keys()
+	s.windowLog = append(s.windowLog, top)
+	if len(s.windowLog) > s.windows {
+		s.windowLog = s.windowLog[len(s.windowLog)-s.windows:]
+	}
+
+	allowed := map[string]bool{}
+	for _, window := range s.windowLog {
+		for key := range window {
+			allowed[key] = true
+		}
+	}
+	s.allowed = allowed
+
+	s.cms = newCountMinSketch()
+	s.topHeap = newTopKHeap(s.k)
+}
+
+// countMinSketch is a small fixed-size count-min sketch used to estimate key
+// frequencies within the current window without storing one counter per
+// distinct key.
+type countMinSketch struct {
+	depth, width int
+	counts       [][]uint32
+}
+
+func newCountMinSketch() *countMinSketch {
+	const depth, width = 4, 2048
+	counts := make([][]uint32, depth)
+	for i := range counts {
+		counts[i] = make([]uint32, width)
+	}
+	return &countMinSketch{depth: depth, width: width, counts: counts}
+}
+
+func (c *countMinSketch) add(key string) {
+	for i := 0; i < c.depth; i++ {
+		idx := c.hash(key, i)
+		c.counts[i][idx]++
+	}
+}
+
+func (c *countMinSketch) estimate(key string) uint32 {
+	min := ^uint32(0)
+	for i := 0; i < c.depth; i++ {
+		idx := c.hash(key, i)
+		if c.counts[i][idx] < min {
+			min = c.counts[i][idx]
+		}
+	}
+	return min
+}
+
+func (c *countMinSketch) hash(key string, row int) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(row)})
+	h.Write([]byte(key))
+	return int(h.Sum32()) % c.width
+}
+
+// topKHeapEntry/topKHeap track the K highest-estimated-count keys seen since
+// the last rotation, via a standard min-heap-of-size-K.
+type topKHeapEntry struct {
+	key   string
+	count uint32
+}
+
+type topKHeap struct {
+	k       int
+	entries []topKHeapEntry
+	index   map[string]int
+}
+
+func newTopKHeap(k int) *topKHeap {
+	return &topKHeap{k: k, index: map[string]int{}}
+}
+
+func (h *topKHeap) Len() int { return len(h.entries) }
+func (h *topKHeap) Less(i, j int) bool {
+	return h.entries[i].count < h.entries[j].count
+}
+func (h *topKHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].key] = i
+	h.index[h.entries[j].key] = j
+}
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(topKHeapEntry)
+	h.index[e.key] = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+func (h *topKHeap) Pop() interface{} {
+	old := h.entries
+	n := len(old)
+	e := old[n-1]
+	h.entries = old[:n-1]
+	delete(h.index, e.key)
+	return e
+}
+
+// observe updates the heap's record of key's estimated count, adding it if
+// there's room or it beats the current minimum.
+func (h *topKHeap) observe(key string, count uint32) {
+	if i, ok := h.index[key]; ok {
+		h.entries[i].count = count
+		heap.Fix(h, i)
+		return
+	}
+	if h.Len() < h.k {
+		heap.Push(h, topKHeapEntry{key: key, count: count})
+		return
+	}
+	if h.Len() > 0 && count > h.entries[0].count {
+		heap.Pop(h)
+		heap.Push(h, topKHeapEntry{key: key, count: count})
+	}
+}
+
+func (h *topKHeap) keys() map[string]bool {
+	out := make(map[string]bool, len(h.entries))
+	for _, e := range h.entries {
+		out[e.key] = true
+	}
+	return out
+}
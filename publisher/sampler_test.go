@@ -0,0 +1,59 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestEMASamplerRateDirection(t *testing.T) {
+	s := newEMASampler(&options.Options{SamplerDecay: 1, SamplerInterval: 3600})
+
+	busy := &event.Event{Data: map[string]interface{}{"elb_status_code": int64(200)}}
+	rare := &event.Event{Data: map[string]interface{}{"elb_status_code": int64(500)}}
+
+	for i := 0; i < 100; i++ {
+		s.Sample(busy)
+	}
+	s.Sample(rare)
+	s.rotate()
+
+	busyRate := s.rates[s.keyFunc(busy)]
+	rareRate := s.rates[s.keyFunc(rare)]
+
+	if rareRate != 1 {
+		t.Errorf("rare key rate = %d, want 1", rareRate)
+	}
+	if busyRate <= 1 {
+		t.Errorf("busy key rate = %d, want > 1 (rare key's rate %d)", busyRate, rareRate)
+	}
+}
+
+func TestTopNSamplerAllowlistRotation(t *testing.T) {
+	s, err := newTopNSampler(&options.Options{
+		SamplerTopNK:       1,
+		SamplerTopNKey:     "{{.key}}",
+		SamplerTopNWindows: 1,
+		SamplerInterval:    3600,
+	})
+	if err != nil {
+		t.Fatalf("newTopNSampler: %s", err)
+	}
+
+	hot := &event.Event{Data: map[string]interface{}{"key": "hot"}}
+	rare := &event.Event{Data: map[string]interface{}{"key": "rare"}}
+
+	for i := 0; i < 50; i++ {
+		s.Sample(hot)
+	}
+	s.Sample(rare)
+	s.rotate()
+
+	if !s.allowed["hot"] {
+		t.Error("hot key (50 observations) should be in the top-1 allowlist after rotation")
+	}
+	if s.allowed["rare"] {
+		t.Error("rare key (1 observation) should not be in the top-1 allowlist after rotation")
+	}
+}
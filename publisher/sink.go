@@ -0,0 +1,432 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Sink is a downstream destination for parsed, sampled events. Every sink is
+// fed by its own bounded buffer and batcher (see configuredSink), so Send may
+// be called with anywhere from one to a few hundred events at a time, and a
+// slow sink only affects its own throughput, not the others'.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, events []event.Event) error
+	Close() error
+}
+
+const (
+	sinkBufferSize = 1000
+	sinkBatchSize  = 500
+	sinkBatchWait  = time.Second
+)
+
+// configuredSink pairs a Sink with the filter that decides which events it
+// receives, plus the bounded buffer/batcher that feeds it.
+type configuredSink struct {
+	sink      Sink
+	filter    sinkFilter
+	ch        chan event.Event
+	batchWait time.Duration
+	done      chan struct{}
+}
+
+// newConfiguredSink starts cs.run() in the background. batchWait is the
+// flush-by-age interval for this sink's batcher; a zero value falls back to
+// sinkBatchWait.
+func newConfiguredSink(sink Sink, filter sinkFilter, batchWait time.Duration) *configuredSink {
+	if batchWait <= 0 {
+		batchWait = sinkBatchWait
+	}
+	cs := &configuredSink{
+		sink:      sink,
+		filter:    filter,
+		ch:        make(chan event.Event, sinkBufferSize),
+		batchWait: batchWait,
+		done:      make(chan struct{}),
+	}
+	go cs.run()
+	return cs
+}
+
+// offer hands ev to the sink's buffer if it passes the filter. If the buffer
+// is full -- the sink can't keep up -- the event is dropped rather than
+// blocking the whole pipeline; only a warning is logged.
+func (cs *configuredSink) offer(ev event.Event) {
+	if !cs.filter(ev) {
+		return
+	}
+	select {
+	case cs.ch <- ev:
+	default:
+		logrus.WithField("sink", cs.sink.Name()).Warn("sink buffer full, dropping event")
+	}
+}
+
+// run batches events off cs.ch and flushes them to the sink, either once
+// sinkBatchSize events have accumulated or cs.batchWait has elapsed,
+// whichever comes first. It closes cs.done once cs.ch is closed and the
+// final batch has been flushed.
+func (cs *configuredSink) run() {
+	defer close(cs.done)
+
+	ticker := time.NewTicker(cs.batchWait)
+	defer ticker.Stop()
+
+	var batch []event.Event
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := cs.sink.Send(context.Background(), batch); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"sink":  cs.sink.Name(),
+				"error": err,
+			}).Error("failed to send batch to sink")
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case ev, ok := <-cs.ch:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= sinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close signals the batcher to flush and stop, and blocks until it has --
+// callers must not offer() after calling close.
+func (cs *configuredSink) close() {
+	close(cs.ch)
+	<-cs.done
+}
+
+// dispatchToSinks fans each event out to every configured sink's buffer until
+// in is closed, then signals each sink's batcher to flush and stop.
+func dispatchToSinks(in <-chan event.Event, sinks []*configuredSink) {
+	for ev := range in {
+		for _, cs := range sinks {
+			cs.offer(ev)
+		}
+	}
+	for _, cs := range sinks {
+		cs.close()
+	}
+}
+
+// sinkFilter decides whether a given event should be routed to a sink.
+type sinkFilter func(event.Event) bool
+
+func keepAll(event.Event) bool { return true }
+
+// buildSinks turns opt.Sinks (the repeated --sink flag) into configured
+// sinks. When no --sink flags are given, it preserves the pre-existing
+// default behavior: ship everything to Loki, plus OTLP if otlp_endpoint is
+// set.
+func buildSinks(opt *options.Options) ([]*configuredSink, error) {
+	if len(opt.Sinks) == 0 {
+		return defaultSinks(opt)
+	}
+
+	var sinks []*configuredSink
+	for _, spec := range opt.Sinks {
+		name, filter, err := parseSinkSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing --sink %q: %s", spec, err)
+		}
+		sink, err := newSinkByName(name, opt)
+		if err != nil {
+			return nil, fmt.Errorf("configuring --sink %q: %s", spec, err)
+		}
+		sinks = append(sinks, newConfiguredSink(sink, filter, batchWaitFor(name, opt)))
+	}
+	return sinks, nil
+}
+
+func defaultSinks(opt *options.Options) ([]*configuredSink, error) {
+	sinks := []*configuredSink{newConfiguredSink(newLokiSink(opt), keepAll, opt.LokiBatchWait)}
+
+	if opt.OTLPEndpoint != "" {
+		exporter, err := newOTLPExporter(opt)
+		if err != nil {
+			logrus.WithError(err).Error("failed to set up otlp exporter, events will not be exported over otlp")
+		} else {
+			sinks = append(sinks, newConfiguredSink(exporter, keepAll, 0))
+		}
+	}
+
+	return sinks, nil
+}
+
+// batchWaitFor returns the flush-by-age interval for a named sink; only the
+// loki sink has a user-tunable one (--loki_batch_wait).
+func batchWaitFor(name string, opt *options.Options) time.Duration {
+	if name == "loki" {
+		return opt.LokiBatchWait
+	}
+	return 0
+}
+
+func newSinkByName(name string, opt *options.Options) (Sink, error) {
+	switch name {
+	case "loki":
+		return newLokiSink(opt), nil
+	case "otlp":
+		return newOTLPExporter(opt)
+	case "honeycomb":
+		return &honeycombSink{}, nil
+	case "stdout":
+		return stdoutSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q, want one of loki, otlp, honeycomb, stdout", name)
+	}
+}
+
+// parseSinkSpec splits a --sink value of the form "name" or
+// "name:filterexpr" into the sink name and its parsed filter. A missing
+// filter, or the literal "*", keeps every event.
+func parseSinkSpec(spec string) (string, sinkFilter, error) {
+	name := spec
+	expr := "*"
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		name = spec[:idx]
+		expr = spec[idx+1:]
+	}
+
+	filter, err := parseSinkFilterExpr(expr)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, filter, nil
+}
+
+// parseSinkFilterExpr parses a single comparison, e.g. "elb_status_code>=500"
+// or "request_path==/health", into a sinkFilter. "*" (or an empty
+// expression) matches everything.
+func parseSinkFilterExpr(expr string) (sinkFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" || expr == "*" {
+		return keepAll, nil
+	}
+
+	// Longer operators must be checked before their prefixes (e.g. ">="
+	// before ">").
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if idx := strings.Index(expr, op); idx > 0 {
+			field := strings.TrimSpace(expr[:idx])
+			value := strings.TrimSpace(expr[idx+len(op):])
+			if isOrderedOp(op) {
+				if _, err := strconv.ParseFloat(value, 64); err != nil {
+					return nil, fmt.Errorf("sink filter %q: %s requires a numeric value, got %q", expr, op, value)
+				}
+			}
+			return buildComparisonFilter(field, op, value), nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid sink filter expression %q", expr)
+}
+
+// isOrderedOp reports whether op is a magnitude comparison rather than an
+// equality one -- ordered comparisons only make sense against a numeric
+// value, since events carry no defined lexical ordering for strings.
+func isOrderedOp(op string) bool {
+	switch op {
+	case ">=", "<=", ">", "<":
+		return true
+	default:
+		return false
+	}
+}
+
+func buildComparisonFilter(field, op, value string) sinkFilter {
+	wantNum, isNum := strconv.ParseFloat(value, 64)
+
+	return func(ev event.Event) bool {
+		raw, ok := ev.Data[field]
+		if !ok {
+			return false
+		}
+
+		if isNum == nil {
+			var got float64
+			switch v := raw.(type) {
+			case int64:
+				got = float64(v)
+			case float64:
+				got = v
+			default:
+				return false
+			}
+			switch op {
+			case ">=":
+				return got >= wantNum
+			case "<=":
+				return got <= wantNum
+			case ">":
+				return got > wantNum
+			case "<":
+				return got < wantNum
+			case "==":
+				return got == wantNum
+			case "!=":
+				return got != wantNum
+			}
+			return false
+		}
+
+		got := fmt.Sprintf("%v", raw)
+		switch op {
+		case "==":
+			return got == value
+		case "!=":
+			return got != value
+		default:
+			return false
+		}
+	}
+}
+
+// lokiSink is the cleaned-up version of the batching/gzip/retry Loki pusher.
+// It groups events by stream (label set) and pushes each group through
+// pushLokiBatch, re-chunking by byte size within a single Send call so a
+// large batch from the generic dispatcher doesn't become one oversized Loki
+// push.
+type lokiSink struct {
+	endpoint, id, apiKey, environment string
+	maxBatchSize                      int
+	maxRetries                        int
+	minBackoff, maxBackoff            time.Duration
+}
+
+func newLokiSink(opt *options.Options) *lokiSink {
+	return &lokiSink{
+		endpoint:     opt.GrafanaCloudEndpoint,
+		id:           opt.GrafanaCloudID,
+		apiKey:       opt.GrafanaCloudAPIKey,
+		environment:  opt.Environment,
+		maxBatchSize: opt.LokiBatchSize,
+		maxRetries:   opt.LokiMaxRetries,
+		minBackoff:   opt.LokiMinBackoff,
+		maxBackoff:   opt.LokiMaxBackoff,
+	}
+}
+
+func (s *lokiSink) Name() string { return "loki" }
+
+func (s *lokiSink) Send(ctx context.Context, events []event.Event) error {
+	batches := map[string]*lokiBatch{}
+	var order []string
+
+	var lastErr error
+	pushAndForget := func(key string) {
+		b := batches[key]
+		delete(batches, key)
+		if err := pushLokiBatch(b, s.endpoint, s.id, s.apiKey, s.maxRetries, s.minBackoff, s.maxBackoff); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"stream":  b.labels,
+				"entries": len(b.values),
+				"error":   err,
+			}).Error("dropping loki batch after exhausting retries")
+			lastErr = err
+		}
+	}
+
+	for _, ev := range events {
+		data, err := json.Marshal(ev.Data)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		elb := fmt.Sprintf("%v", ev.Data["elb"])
+		key := streamKey(s.environment, elb)
+		b, ok := batches[key]
+		if !ok {
+			b = newLokiBatch(map[string]string{"environment": s.environment, "service": "honeyaws", "aws_elb": elb})
+			batches[key] = b
+			order = append(order, key)
+		}
+		b.add(ev.Timestamp, string(data))
+
+		if b.full(s.maxBatchSize) {
+			pushAndForget(key)
+		}
+	}
+
+	for _, key := range order {
+		if _, ok := batches[key]; ok {
+			pushAndForget(key)
+		}
+	}
+
+	return lastErr
+}
+
+func (s *lokiSink) Close() error { return nil }
+
+// honeycombSink sends events to Honeycomb via libhoney. libhoney is
+// configured (API key, dataset) by the command that constructs the
+// publisher, same as it always has been.
+type honeycombSink struct{}
+
+func (honeycombSink) Name() string { return "honeycomb" }
+
+func (honeycombSink) Send(ctx context.Context, events []event.Event) error {
+	for _, ev := range events {
+		hev := libhoney.NewEvent()
+		hev.Timestamp = ev.Timestamp
+		if err := hev.Add(ev.Data); err != nil {
+			logrus.WithError(err).Error("failed to add fields to honeycomb event")
+			continue
+		}
+		if err := hev.Send(); err != nil {
+			logrus.WithError(err).Error("failed to send event to honeycomb")
+		}
+	}
+	return nil
+}
+
+func (honeycombSink) Close() error {
+	libhoney.Flush()
+	return nil
+}
+
+// stdoutSink writes each event's fields as a JSON line to stdout, for local
+// debugging.
+type stdoutSink struct{}
+
+func (stdoutSink) Name() string { return "stdout" }
+
+func (stdoutSink) Send(ctx context.Context, events []event.Event) error {
+	for _, ev := range events {
+		b, err := json.Marshal(ev.Data)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+func (stdoutSink) Close() error { return nil }
@@ -0,0 +1,57 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestParseSinkFilterExprRejectsNonNumericOrderedComparison(t *testing.T) {
+	if _, err := parseSinkFilterExpr("request_path>=/health"); err == nil {
+		t.Fatal("expected an error for an ordered comparison against a non-numeric value, got nil")
+	}
+}
+
+func TestParseSinkFilterExprKeepAll(t *testing.T) {
+	filter, err := parseSinkFilterExpr("*")
+	if err != nil {
+		t.Fatalf("parseSinkFilterExpr(\"*\"): %s", err)
+	}
+	if !filter(event.Event{}) {
+		t.Error("the \"*\" filter should keep every event")
+	}
+}
+
+func TestBuildComparisonFilterNumeric(t *testing.T) {
+	filter, err := parseSinkFilterExpr("elb_status_code>=500")
+	if err != nil {
+		t.Fatalf("parseSinkFilterExpr: %s", err)
+	}
+
+	ok := event.Event{Data: map[string]interface{}{"elb_status_code": int64(503)}}
+	under := event.Event{Data: map[string]interface{}{"elb_status_code": int64(200)}}
+
+	if !filter(ok) {
+		t.Error("elb_status_code=503 should pass elb_status_code>=500")
+	}
+	if filter(under) {
+		t.Error("elb_status_code=200 should not pass elb_status_code>=500")
+	}
+}
+
+func TestBuildComparisonFilterStringEquality(t *testing.T) {
+	filter, err := parseSinkFilterExpr("request_path==/health")
+	if err != nil {
+		t.Fatalf("parseSinkFilterExpr: %s", err)
+	}
+
+	match := event.Event{Data: map[string]interface{}{"request_path": "/health"}}
+	noMatch := event.Event{Data: map[string]interface{}{"request_path": "/other"}}
+
+	if !filter(match) {
+		t.Error("request_path=/health should pass request_path==/health")
+	}
+	if filter(noMatch) {
+		t.Error("request_path=/other should not pass request_path==/health")
+	}
+}
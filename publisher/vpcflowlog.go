@@ -0,0 +1,110 @@
+package publisher
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeyaws/options"
+	"github.com/honeycombio/honeyaws/state"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/sirupsen/logrus"
+)
+
+// vpcFlowLogIntFields lists the VPC Flow Log fields that are numeric rather
+// than strings, across the v2-v5 field sets.
+var vpcFlowLogIntFields = map[string]bool{
+	"srcport":     true,
+	"dstport":     true,
+	"protocol":    true,
+	"packets":     true,
+	"bytes":       true,
+	"start":       true,
+	"end":         true,
+	"tcp-flags":   true,
+	"pkt-srcport": true,
+	"pkt-dstport": true,
+}
+
+// VPCFlowLogEventParser implements EventParser for AWS VPC Flow Logs. Unlike
+// the nginx-style `log_format` templates used for ELB/ALB/CloudFront, flow
+// log field order isn't fixed across versions (v2-v5 add fields over time),
+// so each object's header line is read to determine field order dynamically.
+type VPCFlowLogEventParser struct {
+	Opt *options.Options
+}
+
+func (p *VPCFlowLogEventParser) ParseEvents(obj state.DownloadedObject, out chan<- event.Event) error {
+	f, err := os.Open(obj.Filename)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", obj.Filename, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return fmt.Errorf("empty vpc flow log object %s", obj.Object)
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(scanner.Text(), "#fields "))
+	if len(fields) == 0 {
+		return fmt.Errorf("no header fields found in %s", obj.Object)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		values := strings.Fields(line)
+		if len(values) != len(fields) {
+			logrus.WithFields(logrus.Fields{
+				"object": obj.Object,
+				"line":   line,
+			}).Warn("vpc flow log line doesn't match header field count, skipping")
+			continue
+		}
+
+		ev := event.Event{Data: map[string]interface{}{}}
+		for i, field := range fields {
+			val := values[i]
+			if val == "-" {
+				continue
+			}
+			if vpcFlowLogIntFields[field] {
+				if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+					ev.Data[field] = n
+					continue
+				}
+			}
+			ev.Data[field] = val
+		}
+
+		if start, ok := ev.Data["start"].(int64); ok {
+			ev.Timestamp = time.Unix(start, 0).UTC()
+		} else {
+			ev.Timestamp = time.Now().UTC()
+		}
+
+		out <- ev
+	}
+
+	return scanner.Err()
+}
+
+// DynSample applies the configured sampler (see options.Options.SamplerType)
+// to VPC Flow Log events. Flow logs don't carry request_path/elb_status_code,
+// so sampler_topn_key should be set to a flow-log-specific field (e.g.
+// srcaddr/dstport) when sampler_type is "topn".
+func (p *VPCFlowLogEventParser) DynSample(in <-chan event.Event, out chan<- event.Event) {
+	sampler := NewSampler(p.Opt)
+	for ev := range in {
+		if sampler.Sample(&ev) {
+			out <- ev
+		}
+	}
+	close(out)
+}